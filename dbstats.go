@@ -0,0 +1,17 @@
+package main
+
+import "time"
+
+// collectDBStats periodically samples database.db.Stats() and publishes the
+// pool's open/in-use connection counts, so operators get a pool-saturation
+// signal instead of only the last-scrape up/down gauge.
+func collectDBStats(database Database, metrics *metricSet, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		stats := database.db.Stats()
+		metrics.dbOpenConnections.WithLabelValues(database.Database).Set(float64(stats.OpenConnections))
+		metrics.dbInUse.WithLabelValues(database.Database).Set(float64(stats.InUse))
+	}
+}
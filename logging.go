@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"strconv"
+	"sync/atomic"
+)
+
+var logger *slog.Logger
+
+var (
+	logFormat string
+	logLevel  string
+)
+
+// initLogging (re)configures the package-level logger to write to output in
+// either text or json form, per the --log.format and --log.level flags.
+func initLogging(output io.Writer) {
+	opts := &slog.HandlerOptions{Level: parseLogLevel(logLevel)}
+
+	var handler slog.Handler
+	if logFormat == "json" {
+		handler = slog.NewJSONHandler(output, opts)
+	} else {
+		handler = slog.NewTextHandler(output, opts)
+	}
+	logger = slog.New(handler)
+}
+
+func parseLogLevel(level string) slog.Level {
+	switch level {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+var scrapeIDCounter uint64
+
+// nextScrapeID returns a process-unique id for a single execQuery
+// invocation, so its log lines can be grepped end-to-end.
+func nextScrapeID() string {
+	return strconv.FormatUint(atomic.AddUint64(&scrapeIDCounter, 1), 10)
+}
+
+// truncateSQL shortens sqlText to maxLen for logging and returns a short hash
+// of the full text, so a truncated log line can still be correlated back to
+// the exact query that produced it.
+func truncateSQL(sqlText string, maxLen int) (snippet string, hash string) {
+	sum := sha256.Sum256([]byte(sqlText))
+	hash = hex.EncodeToString(sum[:])[:12]
+
+	if len(sqlText) > maxLen {
+		return sqlText[:maxLen] + "...", hash
+	}
+	return sqlText, hash
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// metricSet groups the Prometheus metrics emitted for a batch of scrapes. The
+// default set is registered against the global registry for statically
+// configured databases; /probe requests get their own metricSet registered
+// into a throwaway registry so concurrent probes don't share label state.
+type metricSet struct {
+	error             *prometheus.GaugeVec
+	duration          *prometheus.GaugeVec
+	up                *prometheus.GaugeVec
+	scrapesTotal      *prometheus.CounterVec
+	scrapeErrorsTotal *prometheus.CounterVec
+	dbOpenConnections *prometheus.GaugeVec
+	dbInUse           *prometheus.GaugeVec
+	buildInfo         *prometheus.GaugeVec
+	queries           map[string]*queryMetric
+}
+
+// queryMetric is the metric family backing a single configured query. Exactly
+// one of counter/gauge/histogram/summary is set, chosen by Query.MetricType,
+// so a single query can populate a rich metric family (histogram buckets,
+// label pairs from non-numeric columns) instead of one unrelated gauge per
+// column.
+type queryMetric struct {
+	counter   *prometheus.CounterVec
+	gauge     *prometheus.GaugeVec
+	histogram *prometheus.HistogramVec
+	summary   *prometheus.SummaryVec
+}
+
+func newMetricSet(reg prometheus.Registerer, queries []Query) *metricSet {
+	m := &metricSet{
+		error: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "query_error",
+			Help:      "Result of last query, 1 if we have errors on running query",
+		}, []string{"database", "name"}),
+		duration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "query_duration_seconds",
+			Help:      "Duration of the query in seconds",
+		}, []string{"database", "name"}),
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "up",
+			Help:      "Database status",
+		}, []string{"database"}),
+		scrapesTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrapes_total",
+			Help:      "Total number of times a database/query pair has been scraped",
+		}, []string{"database", "query"}),
+		scrapeErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "scrape_errors_total",
+			Help:      "Total number of scrape errors per database/query pair, by error_type (timeout, connect, query, scan, parse, label)",
+		}, []string{"database", "query", "error_type"}),
+		dbOpenConnections: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "db_open_connections",
+			Help:      "Number of established connections to the database, from sql.DB.Stats()",
+		}, []string{"database"}),
+		dbInUse: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "db_in_use",
+			Help:      "Number of connections currently in use, from sql.DB.Stats()",
+		}, []string{"database"}),
+		buildInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      "build_info",
+			Help:      "A constant 1, labeled by version, commit and goversion",
+		}, []string{"version", "commit", "goversion"}),
+		queries: map[string]*queryMetric{},
+	}
+	reg.MustRegister(m.error, m.duration, m.up, m.scrapesTotal, m.scrapeErrorsTotal, m.dbOpenConnections, m.dbInUse, m.buildInfo)
+	m.buildInfo.WithLabelValues(Version, Commit, runtime.Version()).Set(1)
+
+	for _, query := range queries {
+		if _, ok := m.queries[query.Name]; ok {
+			continue
+		}
+		qm, err := newQueryMetric(reg, query)
+		if err != nil {
+			logger.Error("skipping query with invalid metric configuration", "query", query.Name, "err", err)
+			continue
+		}
+		m.queries[query.Name] = qm
+	}
+	return m
+}
+
+// newQueryMetric registers the metric family for query, using "database",
+// query.Labels and "col" as the label set. "col" carries the result column
+// name so a query returning several numeric columns (e.g. count(*) AS c1,
+// sum(x) AS c2) gets one series per column instead of them overwriting or
+// merging into each other. It returns an error instead of registering
+// anything if query.Name isn't a valid Prometheus metric name, so a single
+// misconfigured query can't take down the whole exporter via MustRegister.
+func newQueryMetric(reg prometheus.Registerer, query Query) (*queryMetric, error) {
+	if !model.IsValidMetricName(model.LabelValue(query.Name)) {
+		return nil, fmt.Errorf("%q is not a valid metric name", query.Name)
+	}
+
+	labels := append([]string{"database"}, query.Labels...)
+	labels = append(labels, "col")
+	help := query.Help
+	if help == "" {
+		help = "Value of business metric from database query " + query.Name
+	}
+
+	qm := &queryMetric{}
+	switch query.MetricType {
+	case "counter":
+		qm.counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      query.Name,
+			Help:      help,
+		}, labels)
+		reg.MustRegister(qm.counter)
+	case "histogram":
+		buckets := query.Buckets
+		if len(buckets) == 0 {
+			buckets = prometheus.DefBuckets
+		}
+		qm.histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      query.Name,
+			Help:      help,
+			Buckets:   buckets,
+		}, labels)
+		reg.MustRegister(qm.histogram)
+	case "summary":
+		qm.summary = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      query.Name,
+			Help:      help,
+		}, labels)
+		reg.MustRegister(qm.summary)
+	default:
+		qm.gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: exporter,
+			Name:      query.Name,
+			Help:      help,
+		}, labels)
+		reg.MustRegister(qm.gauge)
+	}
+	return qm, nil
+}
+
+// observe routes a numeric column value to the right Prometheus method for
+// this query's configured metric type. It returns an error instead of
+// observing the value if doing so would panic, e.g. Counter.Add rejects any
+// negative value, which a query column can easily produce (a decreasing
+// count, a negative delta, ...).
+func (qm *queryMetric) observe(labelValues []string, value float64) error {
+	switch {
+	case qm.counter != nil:
+		if value < 0 {
+			return fmt.Errorf("counter value %v is negative", value)
+		}
+		qm.counter.WithLabelValues(labelValues...).Add(value)
+	case qm.histogram != nil:
+		qm.histogram.WithLabelValues(labelValues...).Observe(value)
+	case qm.summary != nil:
+		qm.summary.WithLabelValues(labelValues...).Observe(value)
+	default:
+		qm.gauge.WithLabelValues(labelValues...).Set(value)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// writeMetric extracts the dto.Metric backing a prometheus.Observer (the
+// interface HistogramVec/SummaryVec.WithLabelValues return), so their
+// samples -- which testutil.ToFloat64 can't read -- can be asserted on
+// directly. The concrete type behind Observer always also implements
+// prometheus.Metric.
+func writeMetric(t *testing.T, o prometheus.Observer) *dto.Metric {
+	t.Helper()
+	m, ok := o.(prometheus.Metric)
+	if !ok {
+		t.Fatalf("%T does not implement prometheus.Metric", o)
+	}
+	out := &dto.Metric{}
+	if err := m.Write(out); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	return out
+}
+
+// TestExecQueryMetricTypes covers the counter/gauge/histogram/summary
+// routing in queryMetric.observe -- for each configured Query.MetricType, a
+// scraped column must land in the matching Prometheus metric type.
+func TestExecQueryMetricTypes(t *testing.T) {
+	initLogging(io.Discard)
+
+	origTimeout := timeout
+	timeout = 30
+	defer func() { timeout = origTimeout }()
+
+	for _, metricType := range []string{"gauge", "counter", "histogram", "summary"} {
+		t.Run(metricType, func(t *testing.T) {
+			dsn := "metrictype_" + metricType
+			staticConns[dsn] = &staticConn{
+				columns: []string{"value"},
+				rows:    [][]driver.Value{{int64(3)}},
+			}
+			db, err := sql.Open("statictest", dsn)
+			if err != nil {
+				t.Fatalf("sql.Open: %v", err)
+			}
+			defer db.Close()
+
+			query := Query{Sql: "SELECT value", Name: "type_" + metricType, MetricType: metricType}
+			reg := prometheus.NewRegistry()
+			metrics := newMetricSet(reg, []Query{query})
+
+			execQuery(db, "testdb", "statictest", query, metrics)
+
+			qm := metrics.queries[query.Name]
+			if qm == nil {
+				t.Fatalf("query %q has no registered metric", query.Name)
+			}
+
+			switch metricType {
+			case "counter":
+				if got := testutil.ToFloat64(qm.counter.WithLabelValues("testdb", "value")); got != 3 {
+					t.Errorf("counter value = %v, want 3", got)
+				}
+			case "histogram":
+				h := writeMetric(t, qm.histogram.WithLabelValues("testdb", "value")).GetHistogram()
+				if h.GetSampleCount() != 1 || h.GetSampleSum() != 3 {
+					t.Errorf("histogram = count:%d sum:%v, want count:1 sum:3", h.GetSampleCount(), h.GetSampleSum())
+				}
+			case "summary":
+				s := writeMetric(t, qm.summary.WithLabelValues("testdb", "value")).GetSummary()
+				if s.GetSampleCount() != 1 || s.GetSampleSum() != 3 {
+					t.Errorf("summary = count:%d sum:%v, want count:1 sum:3", s.GetSampleCount(), s.GetSampleSum())
+				}
+			default:
+				if got := testutil.ToFloat64(qm.gauge.WithLabelValues("testdb", "value")); got != 3 {
+					t.Errorf("gauge value = %v, want 3", got)
+				}
+			}
+		})
+	}
+}
+
+// TestExecQueryNegativeCounterDoesNotPanic verifies a query column that
+// yields a negative value for a type: counter query is skipped with a
+// parse error instead of panicking inside CounterVec.Add.
+func TestExecQueryNegativeCounterDoesNotPanic(t *testing.T) {
+	initLogging(io.Discard)
+
+	origTimeout := timeout
+	timeout = 30
+	defer func() { timeout = origTimeout }()
+
+	staticConns["negcounter"] = &staticConn{
+		columns: []string{"value"},
+		rows:    [][]driver.Value{{int64(-5)}},
+	}
+	db, err := sql.Open("statictest", "negcounter")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	query := Query{Sql: "SELECT value", Name: "neg_counter_metric", MetricType: "counter"}
+	reg := prometheus.NewRegistry()
+	metrics := newMetricSet(reg, []Query{query})
+
+	execQuery(db, "testdb", "statictest", query, metrics)
+
+	if got := testutil.ToFloat64(metrics.scrapeErrorsTotal.WithLabelValues("testdb", "neg_counter_metric", "parse")); got != 1 {
+		t.Errorf("scrape_errors_total{error_type=parse} = %v, want 1", got)
+	}
+	qm := metrics.queries["neg_counter_metric"]
+	if got := testutil.ToFloat64(qm.counter.WithLabelValues("testdb", "value")); got != 0 {
+		t.Errorf("counter value = %v, want 0 (sample should be skipped, not applied)", got)
+	}
+}
+
+// TestNewMetricSetSkipsInvalidMetricName verifies a query whose Name isn't a
+// valid Prometheus metric identifier (e.g. containing a space or a leading
+// digit) is skipped with a logged error instead of panicking the whole
+// process via reg.MustRegister.
+func TestNewMetricSetSkipsInvalidMetricName(t *testing.T) {
+	initLogging(io.Discard)
+
+	reg := prometheus.NewRegistry()
+	bad := Query{Sql: "SELECT 1", Name: "disk usage", MetricType: "gauge"}
+	good := Query{Sql: "SELECT 1", Name: "disk_usage", MetricType: "gauge"}
+
+	metrics := newMetricSet(reg, []Query{bad, good})
+
+	if _, ok := metrics.queries["disk usage"]; ok {
+		t.Errorf("invalid metric name %q should not have been registered", bad.Name)
+	}
+	if _, ok := metrics.queries["disk_usage"]; !ok {
+		t.Errorf("valid metric name %q should still have been registered", good.Name)
+	}
+}
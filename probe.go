@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// AuthModule holds the credentials for a named group of probe targets, so
+// that sensitive info stays out of Prometheus scrape URLs: relabel_configs
+// pass only ?target=host:port and ?auth_module=name, and the probe handler
+// resolves auth_module to a DSN template.
+type AuthModule struct {
+	Driver   string  `fig:"driver,default=postgres"`
+	User     string  `fig:"user"`
+	Password string  `fig:"password"`
+	Database string  `fig:"database"`
+	Queries  []Query `fig:"queries"`
+}
+
+var (
+	probeConnsMu sync.Mutex
+	probeConns   = map[string]*sql.DB{}
+)
+
+// probeHandler implements the postgres_exporter multi-target pattern: a
+// single exporter instance is pointed at many databases via Prometheus
+// relabel_configs instead of enumerating every one of them in config.yaml.
+// ?target=host:port selects the database to connect to and ?auth_module=name
+// selects the credentials and queries to run against it.
+func probeHandler(w http.ResponseWriter, r *http.Request) {
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	authModuleName := r.URL.Query().Get("auth_module")
+	authModule, ok := configuration.AuthModules[authModuleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown auth_module %q", authModuleName), http.StatusBadRequest)
+		return
+	}
+
+	db, err := probeConnection(target, authModule)
+	if err != nil {
+		logger.Error("probe: error connecting to target", "target", target, "auth_module", authModuleName, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+	metrics := newMetricSet(registry, authModule.Queries)
+	if err := db.Ping(); err != nil {
+		logger.Error("probe: error on connect to target", "target", target, "auth_module", authModuleName, "err", err)
+		metrics.up.WithLabelValues(target).Set(0)
+	} else {
+		metrics.up.WithLabelValues(target).Set(1)
+		for _, query := range authModule.Queries {
+			execQuery(db, target, authModule.Driver, query, metrics)
+		}
+	}
+
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
+
+// probeConnection returns a pooled *sql.DB for target/authModule, opening and
+// caching a new one on first use so repeated scrapes of the same target
+// reuse a connection instead of paying setup cost every time.
+func probeConnection(target string, authModule AuthModule) (*sql.DB, error) {
+	key := authModule.Driver + "|" + authModule.Database + "|" + target
+
+	probeConnsMu.Lock()
+	defer probeConnsMu.Unlock()
+
+	if db, ok := probeConns[key]; ok {
+		return db, nil
+	}
+
+	dsn, err := probeDsn(target, authModule)
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open(authModule.Driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetMaxOpenConns(maxOpenConns)
+	probeConns[key] = db
+	return db, nil
+}
+
+// probeDsn merges a target's host:port with an auth_module's credentials into
+// a driver-specific DSN, mirroring the template main() builds for statically
+// configured databases.
+func probeDsn(target string, authModule AuthModule) (string, error) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", fmt.Errorf("invalid target %q: %w", target, err)
+	}
+
+	if authModule.Driver == "postgres" {
+		return fmt.Sprintf("user=%s password=%s host=%s port=%s dbname=%s sslmode=disable",
+			authModule.User, authModule.Password, host, port, authModule.Database), nil
+	}
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s", authModule.User, authModule.Password, host, port, authModule.Database), nil
+}
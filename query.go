@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// scrapeDatabase runs query against a statically configured database,
+// reconnecting first if the pooled connection was closed, and records the
+// result via metrics. This is the entry point cron jobs call for the
+// databases enumerated in config.yaml.
+func scrapeDatabase(database Database, query Query, metrics *metricSet) {
+	// Reconnect if we lost connection
+	if err := database.db.Ping(); err != nil {
+		if strings.Contains(err.Error(), "sql: database is closed") {
+			logger.Info("reconnecting to db", "db", database.Database)
+			database.db, _ = sql.Open(database.Driver, database.Dsn)
+			database.db.SetMaxIdleConns(maxIdleConns)
+			database.db.SetMaxOpenConns(maxOpenConns)
+		}
+	}
+
+	// Validate connection
+	if err := database.db.Ping(); err != nil {
+		logger.Error("error on connect to database", "db", database.Database, "err", err)
+		metrics.up.WithLabelValues(database.Database).Set(0)
+		metrics.scrapeErrorsTotal.WithLabelValues(database.Database, query.Name, "connect").Inc()
+		return
+	}
+	metrics.up.WithLabelValues(database.Database).Set(1)
+
+	execQuery(database.db, database.Database, database.Driver, query, metrics)
+}
+
+// execQuery runs query against db and records the value, error and duration
+// under dbLabel into metrics. db may be a pooled, statically configured
+// connection or an ad-hoc connection opened for a single /probe request.
+func execQuery(db *sql.DB, dbLabel, driver string, query Query, metrics *metricSet) {
+	scrapeID := nextScrapeID()
+	metrics.scrapesTotal.WithLabelValues(dbLabel, query.Name).Inc()
+
+	rowCount := 0
+	defer func(begun time.Time) {
+		duration := time.Since(begun)
+		metrics.duration.WithLabelValues(dbLabel, query.Name).Set(duration.Seconds())
+		logger.Debug("scrape complete",
+			"scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver,
+			"duration_ms", duration.Milliseconds(), "rows", rowCount)
+
+		if duration > slowQueryThreshold {
+			snippet, hash := truncateSQL(query.Sql, 200)
+			logger.Warn("slow query",
+				"scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver,
+				"duration_ms", duration.Milliseconds(), "sql", snippet, "sql_hash", hash)
+		}
+	}(time.Now())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	defer cancel()
+	rows, err := queryWithTimeout(ctx, db, query.Sql)
+	if err == context.DeadlineExceeded {
+		logger.Error("query timed out", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "err", err)
+		metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+		metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "timeout").Inc()
+		return
+	}
+	if err != nil {
+		logger.Error("query failed", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "err", err)
+		metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+		metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "query").Inc()
+		return
+	}
+	defer func() {
+		if err := rows.Close(); err != nil {
+			logger.Error("error closing rows", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "err", err)
+		}
+	}()
+
+	qm, ok := metrics.queries[query.Name]
+	if !ok {
+		logger.Error("query has no registered metric", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver)
+		metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+		metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "parse").Inc()
+		return
+	}
+	isLabelCol := make(map[string]bool, len(query.Labels))
+	for _, l := range query.Labels {
+		isLabelCol[l] = true
+	}
+
+	cols, _ := rows.Columns()
+	isCol := make(map[string]bool, len(cols))
+	for _, c := range cols {
+		isCol[c] = true
+	}
+	for _, l := range query.Labels {
+		if !isCol[l] {
+			logger.Error("configured label column not in result set", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "label", l, "cols", cols)
+			metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+			metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "label").Inc()
+			return
+		}
+	}
+
+	vals := make([]interface{}, len(cols))
+	for rows.Next() {
+		for i := range cols {
+			vals[i] = &vals[i]
+		}
+
+		if err = rows.Scan(vals...); err != nil {
+			logger.Error("error scanning row", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "err", err)
+			metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+			metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "scan").Inc()
+			break
+		}
+		rowCount++
+
+		labelValues := make([]string, 0, len(query.Labels)+1)
+		labelValues = append(labelValues, dbLabel)
+		for _, l := range query.Labels {
+			for i, c := range cols {
+				if c == l {
+					str, _ := dbToString(vals[i])
+					labelValues = append(labelValues, str)
+				}
+			}
+		}
+
+		metrics.error.WithLabelValues(dbLabel, query.Name).Set(0)
+		for i, c := range cols {
+			if isLabelCol[c] {
+				continue
+			}
+			float, ok := dbToFloat64(vals[i])
+			if !ok {
+				logger.Error("cannot convert value to float", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "col", cols[i], "value", fmt.Sprintf("%v", vals[i]))
+				metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+				metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "parse").Inc()
+				return
+			}
+			colLabelValues := make([]string, 0, len(labelValues)+1)
+			colLabelValues = append(colLabelValues, labelValues...)
+			colLabelValues = append(colLabelValues, c)
+			if err := qm.observe(colLabelValues, float); err != nil {
+				logger.Error("cannot observe query result", "scrape_id", scrapeID, "db", dbLabel, "query", query.Name, "driver", driver, "col", c, "value", float, "err", err)
+				metrics.error.WithLabelValues(dbLabel, query.Name).Set(1)
+				metrics.scrapeErrorsTotal.WithLabelValues(dbLabel, query.Name, "parse").Inc()
+				continue
+			}
+		}
+	}
+}
+
+// queryResult is the payload sent back by the goroutine that runs the actual
+// query in queryWithTimeout.
+type queryResult struct {
+	rows *sql.Rows
+	err  error
+}
+
+// queryWithTimeout runs db.QueryContext(ctx, sqlText) in a goroutine and races
+// it against ctx.Done(), instead of waiting on QueryContext directly. Several
+// drivers (including lib/pq and go-sql-driver/mysql under some conditions)
+// keep blocking in Query past the deadline since cancellation support isn't
+// guaranteed, so a direct call can run well past timeout. On timeout we
+// return ctx.Err() right away and leave a goroutine behind to drain and close
+// the rows once the driver does return, so the connection isn't leaked.
+func queryWithTimeout(ctx context.Context, db *sql.DB, sqlText string) (*sql.Rows, error) {
+	resultCh := make(chan queryResult, 1)
+	go func() {
+		rows, err := db.QueryContext(ctx, sqlText)
+		resultCh <- queryResult{rows: rows, err: err}
+	}()
+
+	select {
+	case result := <-resultCh:
+		return result.rows, result.err
+	case <-ctx.Done():
+		go func() {
+			result := <-resultCh
+			if result.rows != nil {
+				_ = result.rows.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// Convert database.sql types to float64s for Prometheus consumption. Null types are mapped to NaN. string and []byte
+// types are mapped as NaN and !ok
+func dbToFloat64(t interface{}) (float64, bool) {
+	switch v := t.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case time.Time:
+		return float64(v.Unix()), true
+	case []byte:
+		// Try and convert to string and then parse to a float64
+		strV := string(v)
+		result, err := strconv.ParseFloat(strV, 64)
+		if err != nil {
+			logger.Error("could not parse []byte", "err", err)
+			return math.NaN(), false
+		}
+		return result, true
+	case string:
+		result, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			logger.Error("could not parse string", "err", err)
+			return math.NaN(), false
+		}
+		return result, true
+	case bool:
+		if v {
+			return 1.0, true
+		}
+		return 0.0, true
+	case nil:
+		return math.NaN(), true
+	default:
+		return math.NaN(), false
+	}
+}
+
+// Convert database.sql to string for Prometheus labels. Null types are mapped to empty strings.
+func dbToString(t interface{}) (string, bool) {
+	switch v := t.(type) {
+	case int64:
+		return fmt.Sprintf("%v", v), true
+	case float64:
+		return fmt.Sprintf("%v", v), true
+	case time.Time:
+		return fmt.Sprintf("%v", v.Unix()), true
+	case nil:
+		return "", true
+	case []byte:
+		// Try and convert to string
+		return string(v), true
+	case string:
+		return v, true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	default:
+		return "", false
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// slowDriver is a fake database/sql driver whose Conn only implements the
+// legacy (non-context-aware) driver.Queryer interface, so database/sql has
+// no way to interrupt it once Query is called -- exactly the class of driver
+// behavior queryWithTimeout's goroutine race is meant to protect against.
+type slowDriver struct{}
+
+func (slowDriver) Open(name string) (driver.Conn, error) { return &slowConn{}, nil }
+
+type slowConn struct{}
+
+func (c *slowConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+func (c *slowConn) Close() error              { return nil }
+func (c *slowConn) Begin() (driver.Tx, error) { return nil, errors.New("not implemented") }
+
+// Query ignores the context entirely and blocks well past any sane timeout,
+// emulating a driver that doesn't honor cancellation.
+func (c *slowConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	time.Sleep(3 * time.Second)
+	return &slowRows{}, nil
+}
+
+type slowRows struct{}
+
+func (r *slowRows) Columns() []string              { return []string{"value"} }
+func (r *slowRows) Close() error                   { return nil }
+func (r *slowRows) Next(dest []driver.Value) error { return io.EOF }
+
+func init() {
+	sql.Register("slowtest", slowDriver{})
+	sql.Register("statictest", staticDriver{})
+}
+
+// staticDriver is a fake driver that serves a fixed, pre-registered set of
+// rows for a given DSN, so execQuery's column/label handling can be tested
+// without a real database.
+type staticDriver struct{}
+
+func (staticDriver) Open(name string) (driver.Conn, error) {
+	conn, ok := staticConns[name]
+	if !ok {
+		return nil, errors.New("statictest: no data registered for dsn " + name)
+	}
+	return conn, nil
+}
+
+var staticConns = map[string]*staticConn{}
+
+type staticConn struct {
+	columns  []string
+	rows     [][]driver.Value
+	queryErr error
+}
+
+func (c *staticConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not implemented")
+}
+func (c *staticConn) Close() error              { return nil }
+func (c *staticConn) Begin() (driver.Tx, error) { return nil, errors.New("not implemented") }
+
+func (c *staticConn) Query(query string, args []driver.Value) (driver.Rows, error) {
+	if c.queryErr != nil {
+		return nil, c.queryErr
+	}
+	return &staticRows{columns: c.columns, rows: c.rows}, nil
+}
+
+type staticRows struct {
+	columns []string
+	rows    [][]driver.Value
+	pos     int
+}
+
+func (r *staticRows) Columns() []string { return r.columns }
+func (r *staticRows) Close() error      { return nil }
+func (r *staticRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.pos])
+	r.pos++
+	return nil
+}
+
+// TestExecQueryMultiColumnQuery verifies a query returning several numeric
+// columns produces one series per column (labeled by "col"), instead of the
+// columns overwriting or merging into a single series.
+func TestExecQueryMultiColumnQuery(t *testing.T) {
+	initLogging(io.Discard)
+
+	origTimeout := timeout
+	timeout = 30
+	defer func() { timeout = origTimeout }()
+
+	staticConns["multicol"] = &staticConn{
+		columns: []string{"c1", "c2"},
+		rows:    [][]driver.Value{{int64(5), int64(7)}},
+	}
+	db, err := sql.Open("statictest", "multicol")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	query := Query{Sql: "SELECT count(*) AS c1, sum(x) AS c2", Name: "multi_metric", MetricType: "gauge"}
+	reg := prometheus.NewRegistry()
+	metrics := newMetricSet(reg, []Query{query})
+
+	execQuery(db, "testdb", "statictest", query, metrics)
+
+	qm := metrics.queries["multi_metric"]
+	if got := testutil.ToFloat64(qm.gauge.WithLabelValues("testdb", "c1")); got != 5 {
+		t.Errorf("col=c1 = %v, want 5", got)
+	}
+	if got := testutil.ToFloat64(qm.gauge.WithLabelValues("testdb", "c2")); got != 7 {
+		t.Errorf("col=c2 = %v, want 7", got)
+	}
+}
+
+// TestExecQueryMissingLabelColumnErrors verifies a configured label column
+// absent from the result set fails the scrape cleanly instead of panicking
+// on WithLabelValues' label cardinality check.
+func TestExecQueryMissingLabelColumnErrors(t *testing.T) {
+	initLogging(io.Discard)
+
+	origTimeout := timeout
+	timeout = 30
+	defer func() { timeout = origTimeout }()
+
+	staticConns["missinglabel"] = &staticConn{
+		columns: []string{"value"},
+		rows:    [][]driver.Value{{int64(1)}},
+	}
+	db, err := sql.Open("statictest", "missinglabel")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	query := Query{Sql: "SELECT value", Name: "label_metric", MetricType: "gauge", Labels: []string{"not_a_column"}}
+	reg := prometheus.NewRegistry()
+	metrics := newMetricSet(reg, []Query{query})
+
+	execQuery(db, "testdb", "statictest", query, metrics)
+
+	if got := testutil.ToFloat64(metrics.scrapeErrorsTotal.WithLabelValues("testdb", "label_metric", "label")); got != 1 {
+		t.Errorf("scrape_errors_total{error_type=label} = %v, want 1", got)
+	}
+}
+
+// TestExecQueryFailureClassifiedAsQueryError verifies a non-timeout query
+// execution failure (e.g. a SQL syntax error) is recorded under error_type
+// "query", keeping it distinct from the "connect" type that scrapeDatabase
+// reserves for the Ping failure path.
+func TestExecQueryFailureClassifiedAsQueryError(t *testing.T) {
+	initLogging(io.Discard)
+
+	origTimeout := timeout
+	timeout = 30
+	defer func() { timeout = origTimeout }()
+
+	staticConns["queryerr"] = &staticConn{queryErr: errors.New("syntax error")}
+	db, err := sql.Open("statictest", "queryerr")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	query := Query{Sql: "SELECT nonsense", Name: "err_metric", MetricType: "gauge"}
+	reg := prometheus.NewRegistry()
+	metrics := newMetricSet(reg, []Query{query})
+
+	execQuery(db, "testdb", "statictest", query, metrics)
+
+	if got := testutil.ToFloat64(metrics.scrapeErrorsTotal.WithLabelValues("testdb", "err_metric", "query")); got != 1 {
+		t.Errorf("scrape_errors_total{error_type=query} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.scrapeErrorsTotal.WithLabelValues("testdb", "err_metric", "connect")); got != 0 {
+		t.Errorf("scrape_errors_total{error_type=connect} = %v, want 0 (reserved for Ping failures)", got)
+	}
+}
+
+func TestExecQueryReturnsWithinTimeoutOnHangingDriver(t *testing.T) {
+	initLogging(io.Discard)
+
+	origTimeout := timeout
+	timeout = 1
+	defer func() { timeout = origTimeout }()
+
+	db, err := sql.Open("slowtest", "test")
+	if err != nil {
+		t.Fatalf("sql.Open: %v", err)
+	}
+	defer db.Close()
+
+	query := Query{Sql: "SELECT value", Name: "slow_metric", MetricType: "gauge"}
+	reg := prometheus.NewRegistry()
+	metrics := newMetricSet(reg, []Query{query})
+
+	begun := time.Now()
+	execQuery(db, "testdb", "slowtest", query, metrics)
+	elapsed := time.Since(begun)
+
+	if elapsed >= time.Duration(timeout+1)*time.Second {
+		t.Fatalf("execQuery took %s, want it to return within ~%ds timeout even though the driver ignores context", elapsed, timeout)
+	}
+
+	if got := testutil.ToFloat64(metrics.error.WithLabelValues("testdb", "slow_metric")); got != 1 {
+		t.Errorf("query_error = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.scrapeErrorsTotal.WithLabelValues("testdb", "slow_metric", "timeout")); got != 1 {
+		t.Errorf("scrape_errors_total{error_type=timeout} = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(metrics.duration.WithLabelValues("testdb", "slow_metric")); got <= 0 {
+		t.Errorf("query_duration_seconds = %v, want > 0", got)
+	}
+}